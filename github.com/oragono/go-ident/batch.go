@@ -0,0 +1,142 @@
+package ident
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PortPair identifies one client/server port combination to query within a
+// QueryBatch call.
+type PortPair struct {
+	PortOnServer int
+	PortOnClient int
+}
+
+// Result is the outcome of a single PortPair within a QueryBatch call.
+type Result struct {
+	PortPair
+	Response Response
+	Err      error
+}
+
+// QueryBatch looks up many PortPairs on the same identd host over a single
+// TCP connection, which cuts connection churn and latency when a lot of IRC
+// clients share one NAT gateway or identd host. Responses are matched back
+// to pairs, not assumed to come back in request order, since some identd
+// implementations reorder or coalesce them.
+//
+// If the server closes the connection before answering every pair (i.e. it
+// doesn't support pipelining), the remaining pairs are looked up individually
+// over fresh connections.
+func QueryBatch(ctx context.Context, ip string, pairs []PortPair, opts ...QueryOption) ([]Result, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	o := defaultQueryOptions()
+	o.ctx = ctx
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	conn, err := dial(o, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stopWatch := watchContext(ctx, conn)
+	defer stopWatch()
+
+	if o.readTimeout > 0 {
+		// Covers writing the pipelined requests as well as reading the
+		// responses back.
+		conn.SetDeadline(time.Now().Add(o.readTimeout))
+	}
+
+	var sb strings.Builder
+	for _, p := range pairs {
+		fmt.Fprintf(&sb, "%d, %d\r\n", p.PortOnClient, p.PortOnServer)
+	}
+	if _, err := conn.Write([]byte(sb.String())); err != nil {
+		return nil, ctxOrErr(ctx, err)
+	}
+
+	results := make([]Result, len(pairs))
+	pending := make(map[PortPair]int, len(pairs))
+	for i, p := range pairs {
+		results[i].PortPair = p
+		pending[p] = i
+	}
+
+	br := bufio.NewReaderSize(conn, maxLineLength)
+	for len(pending) > 0 {
+		line, err := readLineFrom(br)
+		if err != nil {
+			// A cancelled ctx is why the read failed (watchContext
+			// closed conn out from under us); the caller wants the
+			// batch abandoned, not retried one-by-one.
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if o.logger != nil {
+				o.logger.Printf("ident: batch connection to %s ended early, falling back to %d per-query lookups: %v", ip, len(pending), err)
+			}
+			return queryRemaining(ip, pending, results, o), nil
+		}
+
+		portPair, resp, perr := parseIdentLine(line, o)
+		pair, ok := parsePortPair(portPair)
+		if !ok {
+			continue
+		}
+
+		idx, ok := pending[pair]
+		if !ok {
+			continue
+		}
+		results[idx].Response = resp
+		results[idx].Err = perr
+		delete(pending, pair)
+	}
+
+	return results, nil
+}
+
+// queryRemaining looks up each still-pending pair over its own connection,
+// for servers that close up after a single response instead of pipelining.
+func queryRemaining(ip string, pending map[PortPair]int, results []Result, o queryOptions) []Result {
+	for pair, idx := range pending {
+		resp, err := query(ip, pair.PortOnServer, pair.PortOnClient, o)
+		results[idx].Response = resp
+		results[idx].Err = err
+	}
+	return results
+}
+
+// parsePortPair parses a "client-port , server-port" field, as found in the
+// leading segment of a response line. identd servers echo the port pair
+// back in the same order it was sent in the request, which in this package
+// is client-port first (see the request line written in QueryBatch and in
+// query).
+func parsePortPair(s string) (PortPair, bool) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) != 2 {
+		return PortPair{}, false
+	}
+
+	client, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return PortPair{}, false
+	}
+	server, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return PortPair{}, false
+	}
+
+	return PortPair{PortOnServer: server, PortOnClient: client}, true
+}
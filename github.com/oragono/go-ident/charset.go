@@ -0,0 +1,54 @@
+package ident
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeIdentifier transcodes raw to UTF-8 using the charset name the
+// identd server announced, without pulling in an external transcoding
+// library (this tree is vendored as-is into consumers, so it can't carry a
+// dependency that isn't vendored alongside it). Only the charsets RFC 1413
+// servers commonly announce are handled by name; anything else (including
+// multi-byte charsets like SHIFT_JIS, which would need a real transcoding
+// table we don't have here) falls back to the raw bytes, sanitized to valid
+// UTF-8 so Response.Identifier is always safe to drop into an IRC message
+// regardless of whether the announced charset was recognized.
+func decodeIdentifier(raw []byte, charset string) string {
+	switch normalizeCharset(charset) {
+	case "UTF-8", "US-ASCII", "ANSI-X3.4-1968":
+		// Already valid UTF-8 (ASCII is a subset of it); nothing to do.
+		if utf8.Valid(raw) {
+			return string(raw)
+		}
+	case "ISO-8859-1", "LATIN1", "L1":
+		// Every Latin-1 byte maps directly onto the Unicode code point
+		// of the same number, so this is a straight rune-per-byte
+		// widening with no lookup table required.
+		var sb strings.Builder
+		sb.Grow(len(raw))
+		for _, b := range raw {
+			sb.WriteRune(rune(b))
+		}
+		return sb.String()
+	}
+
+	return strings.ToValidUTF8(string(raw), "�")
+}
+
+// normalizeCharset strips the punctuation IANA charset names vary on
+// ("ISO-8859-1" vs "ISO8859-1" vs "iso_8859_1") so the switch above only
+// needs to spell each charset one way.
+func normalizeCharset(charset string) string {
+	charset = strings.ToUpper(strings.TrimSpace(charset))
+	charset = strings.NewReplacer("_", "-", " ", "-").Replace(charset)
+	switch charset {
+	case "ISO8859-1":
+		return "ISO-8859-1"
+	case "UTF8":
+		return "UTF-8"
+	case "ASCII":
+		return "US-ASCII"
+	}
+	return charset
+}
@@ -1,19 +1,35 @@
-// Package ident implements an RFC 1413 client
+// Package ident implements an RFC 1413 ident client and server.
 package ident
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	// maxLineLength caps how much of a response line we'll buffer before
+	// giving up on a peer that isn't respecting RFC 1413's 512-octet
+	// line limit.
+	maxLineLength = 1024
+
+	// defaultPort is the well-known ident port.
+	defaultPort uint16 = 113
+)
+
 // Response is a successful answer to our query to the identd server.
 type Response struct {
 	OS         string
 	Charset    string
 	Identifier string
+
+	// RawIdentifier holds the Identifier field exactly as it came off
+	// the wire, before any charset decoding was applied.
+	RawIdentifier []byte
 }
 
 // ResponseError indicates that the identd server returned an error rather than an
@@ -37,49 +53,170 @@ func (e ProtocolError) Error() string {
 }
 
 // Query makes an Ident query, if timeout is >0 the query is timed out after that many seconds.
+//
+// It's a thin wrapper around QueryWithOptions, kept for backwards
+// compatibility; new callers should prefer QueryWithOptions or QueryContext.
 func Query(ip string, portOnServer, portOnClient int, timeout float64) (Response, error) {
-	var (
-		conn   net.Conn
-		err    error
-		fields []string
-		r      *bufio.Reader
-		resp   string
-	)
-
+	var opts []QueryOption
 	if timeout > 0 {
-		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip, "113"), time.Duration(timeout)*time.Second)
-	} else {
-		conn, err = net.Dial("tcp", net.JoinHostPort(ip, "113"))
+		d := time.Duration(timeout * float64(time.Second))
+		opts = append(opts, WithConnectTimeout(d), WithReadTimeout(d))
+	}
+	return QueryWithOptions(ip, portOnServer, portOnClient, opts...)
+}
+
+// QueryContext is like Query, but the connect and read phases are bounded by
+// separate timeouts and the whole lookup can be cancelled early via ctx,
+// e.g. when the IRC client it's being made on behalf of disconnects.
+func QueryContext(ctx context.Context, ip string, portOnServer, portOnClient int, connectTimeout, readTimeout time.Duration) (Response, error) {
+	return QueryWithOptions(ip, portOnServer, portOnClient,
+		WithContext(ctx),
+		WithConnectTimeout(connectTimeout),
+		WithReadTimeout(readTimeout))
+}
+
+// QueryWithOptions makes an Ident query with the given options, allowing
+// callers to control dialing, timeouts, the queried port and charset
+// decoding. See the QueryOption functions (WithDialer, WithLocalAddr,
+// WithConnectTimeout, WithReadTimeout, WithPort, WithLogger,
+// WithCharsetDecoding, WithContext) for what's configurable.
+func QueryWithOptions(ip string, portOnServer, portOnClient int, opts ...QueryOption) (Response, error) {
+	o := defaultQueryOptions()
+	for _, opt := range opts {
+		opt(&o)
 	}
+	return query(ip, portOnServer, portOnClient, o)
+}
+
+// query performs a single-shot lookup over a fresh connection using already
+// resolved options. It's shared by QueryWithOptions and QueryBatch's
+// per-connection fallback path.
+func query(ip string, portOnServer, portOnClient int, o queryOptions) (Response, error) {
+	conn, err := dial(o, ip)
 	if err != nil {
 		return Response{}, err
 	}
+	defer conn.Close()
 
-	// stop the ident read after <timeout> seconds
-	if timeout > 0 {
-		conn.SetDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
+	ctx := queryContext(o)
+	stopWatch := watchContext(ctx, conn)
+	defer stopWatch()
+
+	if o.readTimeout > 0 {
+		// Covers both the request write and the response read: a slow
+		// peer that accepts the connection but never drains its
+		// receive buffer could otherwise block Write indefinitely.
+		conn.SetDeadline(time.Now().Add(o.readTimeout))
+	}
+
+	if _, err := fmt.Fprintf(conn, "%d, %d\r\n", portOnClient, portOnServer); err != nil {
+		return Response{}, ctxOrErr(ctx, err)
 	}
 
-	_, err = conn.Write([]byte(fmt.Sprintf("%d, %d", portOnClient, portOnServer) + "\r\n"))
+	line, err := readLine(conn)
 	if err != nil {
-		return Response{}, err
+		return Response{}, ctxOrErr(ctx, err)
 	}
 
-	r = bufio.NewReader(conn)
-	resp, err = r.ReadString('\n')
+	_, resp, err := parseIdentLine(line, o)
+	return resp, err
+}
+
+// queryContext returns the context to watch for cancellation, defaulting to
+// a non-cancellable background context when the caller didn't supply one.
+func queryContext(o queryOptions) context.Context {
+	if o.ctx != nil {
+		return o.ctx
+	}
+	return context.Background()
+}
+
+// watchContext closes conn as soon as ctx is done, so a blocked Read/Write
+// unblocks immediately on cancellation instead of waiting out the full
+// connect/read timeout. The returned stop func must be called once the
+// connection is no longer in use, to let the watcher goroutine exit.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ctxOrErr reports ctx's error in place of err when the context is what
+// actually caused the failure (e.g. watchContext closing conn out from
+// under a blocked read), so callers see "context canceled"/"context deadline
+// exceeded" rather than an opaque "use of closed network connection".
+func ctxOrErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// dial opens the TCP connection a query will run over, honouring the
+// configured dialer, local address, connect timeout, port and context.
+func dial(o queryOptions, ip string) (net.Conn, error) {
+	port := o.port
+	if port == 0 {
+		port = defaultPort
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if o.dialer != nil {
+		return o.dialer(ctx, "tcp", addr)
+	}
+
+	d := net.Dialer{Timeout: o.connectTimeout, LocalAddr: o.localAddr}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// readLine reads a single CRLF-terminated response line from conn, capping
+// how much it will buffer so a server that never sends '\n' can't stall us
+// forever or force unbounded memory growth.
+func readLine(conn net.Conn) (string, error) {
+	return readLineFrom(bufio.NewReaderSize(conn, maxLineLength))
+}
+
+func readLineFrom(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", ProtocolError{string(line)}
+	}
 	if err != nil {
-		return Response{}, err
+		return "", err
 	}
+	return string(line), nil
+}
 
-	fields = strings.SplitN(strings.TrimSpace(resp), " : ", 4)
+// parseIdentLine parses one response line, returning the raw (still
+// unparsed) port-pair field alongside the decoded Response. QueryBatch uses
+// the port-pair to match responses back to requests; a plain Query ignores
+// it.
+func parseIdentLine(line string, o queryOptions) (portPair string, resp Response, err error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " : ", 4)
 	if len(fields) < 3 {
-		return Response{}, ProtocolError{resp}
+		return "", Response{}, ProtocolError{line}
 	}
+	portPair = fields[0]
 
 	switch fields[1] {
 	case "USERID":
 		if len(fields) != 4 {
-			return Response{}, ProtocolError{resp}
+			return portPair, Response{}, ProtocolError{line}
 		}
 
 		var os, charset string
@@ -92,17 +229,24 @@ func Query(ip string, portOnServer, portOnClient int, timeout float64) (Response
 			charset = "US-ASCII"
 		}
 
-		return Response{
-			OS:         os,
-			Charset:    charset,
-			Identifier: fields[3],
+		raw := []byte(fields[3])
+		identifier := string(raw)
+		if o.decodeCharset {
+			identifier = decodeIdentifier(raw, charset)
+		}
+
+		return portPair, Response{
+			OS:            os,
+			Charset:       charset,
+			Identifier:    identifier,
+			RawIdentifier: raw,
 		}, nil
 	case "ERROR":
 		if len(fields) != 3 {
-			return Response{}, ProtocolError{resp}
+			return portPair, Response{}, ProtocolError{line}
 		}
 
-		return Response{}, ResponseError{fields[2]}
+		return portPair, Response{}, ResponseError{fields[2]}
 	}
-	return Response{}, err
+	return portPair, Response{}, ProtocolError{line}
 }
@@ -0,0 +1,375 @@
+package ident
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestParseRequestLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   Request
+		wantOK bool
+	}{
+		{"valid", "12345, 80\r\n", Request{ClientPort: 12345, ServerPort: 80}, true},
+		{"extra whitespace", " 12345 , 80 \r\n", Request{ClientPort: 12345, ServerPort: 80}, true},
+		{"missing comma", "12345 80\r\n", Request{}, false},
+		{"non-numeric", "abc, 80\r\n", Request{}, false},
+		{"port out of range", "70000, 80\r\n", Request{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRequestLine(tt.line)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (got.ClientPort != tt.want.ClientPort || got.ServerPort != tt.want.ServerPort) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortPair(t *testing.T) {
+	pair, ok := parsePortPair("12345 , 80")
+	if !ok {
+		t.Fatal("expected ok")
+	}
+	if want := (PortPair{PortOnServer: 80, PortOnClient: 12345}); pair != want {
+		t.Fatalf("got %+v, want %+v", pair, want)
+	}
+
+	if _, ok := parsePortPair("not-a-port, 80"); ok {
+		t.Fatal("expected failure on malformed port pair")
+	}
+}
+
+func TestParseIdentLine(t *testing.T) {
+	o := defaultQueryOptions()
+
+	portPair, resp, err := parseIdentLine("12345, 80 : USERID : UNIX : someuser\r\n", o)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if portPair != "12345, 80" {
+		t.Fatalf("got port pair %q", portPair)
+	}
+	if resp.OS != "UNIX" || resp.Identifier != "someuser" {
+		t.Fatalf("got %+v", resp)
+	}
+
+	if _, _, err := parseIdentLine("12345, 80 : ERROR : NO-USER\r\n", o); err != ErrNoUser {
+		t.Fatalf("got %v, want %v", err, ErrNoUser)
+	}
+
+	if _, _, err := parseIdentLine("garbage\r\n", o); !isProtocolError(err) {
+		t.Fatalf("got %v, want a ProtocolError", err)
+	}
+}
+
+func isProtocolError(err error) bool {
+	_, ok := err.(ProtocolError)
+	return ok
+}
+
+func TestDecodeIdentifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		charset string
+		want    string
+	}{
+		{"ascii passthrough", []byte("someuser"), "US-ASCII", "someuser"},
+		{"utf-8 passthrough", []byte("caf\xc3\xa9"), "UTF-8", "caf\xc3\xa9"},
+		{"utf-8 alias", []byte("someuser"), "utf8", "someuser"},
+		{"latin-1 high bytes", []byte{0xe9}, "ISO-8859-1", "é"},
+		{"latin-1 alias underscores", []byte{0xe9}, "iso_8859_1", "é"},
+		// Shift-JIS for "日本"; we don't have a transcoding table for it,
+		// so it must at least come back as valid, if lossy, UTF-8 rather
+		// than raw invalid bytes leaking into Response.Identifier.
+		{"unrecognized charset is sanitized", []byte{0x93, 0xfa, 0x96, 0x7b}, "SHIFT_JIS", "�{"},
+		{"empty charset is sanitized like unrecognized", []byte("plain"), "", "plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeIdentifier(tt.raw, tt.charset)
+			if !utf8.ValidString(got) {
+				t.Fatalf("decodeIdentifier(%q, %q) = %q, not valid UTF-8", tt.raw, tt.charset, got)
+			}
+			if got != tt.want {
+				t.Fatalf("decodeIdentifier(%q, %q) = %q, want %q", tt.raw, tt.charset, got, tt.want)
+			}
+		})
+	}
+}
+
+// staticHandler answers every Lookup with a fixed Response or error.
+type staticHandler struct {
+	resp Response
+	err  error
+}
+
+func (h staticHandler) Lookup(Request) (Response, error) {
+	return h.resp, h.err
+}
+
+func startServer(t *testing.T, h Handler) (*Server, *net.TCPAddr) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &Server{Handler: h}
+	if err := srv.Serve(ln); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return srv, ln.Addr().(*net.TCPAddr)
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	_, addr := startServer(t, staticHandler{resp: Response{OS: "UNIX", Identifier: "alice"}})
+
+	resp, err := QueryWithOptions(addr.IP.String(), 80, 12345,
+		WithPort(uint16(addr.Port)), WithReadTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if resp.Identifier != "alice" {
+		t.Fatalf("got %+v", resp)
+	}
+}
+
+func TestServerReportsHandlerError(t *testing.T) {
+	_, addr := startServer(t, staticHandler{err: ErrNoUser})
+
+	_, err := QueryWithOptions(addr.IP.String(), 80, 12345,
+		WithPort(uint16(addr.Port)), WithReadTimeout(2*time.Second))
+	if err != ErrNoUser {
+		t.Fatalf("got %v, want %v", err, ErrNoUser)
+	}
+}
+
+func TestServerShutdownIsIdempotent(t *testing.T) {
+	srv, _ := startServer(t, staticHandler{})
+
+	if err := srv.Shutdown(); err != nil {
+		t.Fatalf("first shutdown: %v", err)
+	}
+	if err := srv.Shutdown(); err != nil {
+		t.Fatalf("second shutdown: %v", err)
+	}
+}
+
+// nonPipeliningIdentd answers only the first request line on each
+// connection and then closes it, simulating an identd that doesn't support
+// RFC 1413 pipelining.
+func nonPipeliningIdentd(t *testing.T) *net.TCPAddr {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				req, ok := parseRequestLine(line)
+				if !ok {
+					return
+				}
+				fmt.Fprintf(conn, "%d, %d : USERID : UNIX : bob\r\n", req.ClientPort, req.ServerPort)
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestQueryBatchFallsBackOnEarlyClose(t *testing.T) {
+	addr := nonPipeliningIdentd(t)
+
+	pairs := []PortPair{
+		{PortOnServer: 80, PortOnClient: 1},
+		{PortOnServer: 81, PortOnClient: 2},
+	}
+	results, err := QueryBatch(context.Background(), addr.IP.String(), pairs,
+		WithPort(uint16(addr.Port)), WithReadTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("QueryBatch: %v", err)
+	}
+	if len(results) != len(pairs) {
+		t.Fatalf("got %d results, want %d", len(results), len(pairs))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("pair %+v: %v", r.PortPair, r.Err)
+		}
+		if r.Response.Identifier != "bob" {
+			t.Fatalf("pair %+v: got %+v", r.PortPair, r.Response)
+		}
+	}
+}
+
+// reorderingIdentd reads n pipelined request lines off a single connection
+// and then answers them in reverse order, simulating an identd that
+// coalesces or reorders pipelined responses.
+func reorderingIdentd(t *testing.T, n int) *net.TCPAddr {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		reqs := make([]Request, 0, n)
+		for i := 0; i < n; i++ {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			req, ok := parseRequestLine(line)
+			if !ok {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+
+		for i := len(reqs) - 1; i >= 0; i-- {
+			req := reqs[i]
+			fmt.Fprintf(conn, "%d, %d : USERID : UNIX : user%d\r\n", req.ClientPort, req.ServerPort, req.ClientPort)
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestQueryBatchMatchesOutOfOrderResponses(t *testing.T) {
+	pairs := []PortPair{
+		{PortOnServer: 80, PortOnClient: 1},
+		{PortOnServer: 81, PortOnClient: 2},
+		{PortOnServer: 82, PortOnClient: 3},
+	}
+	addr := reorderingIdentd(t, len(pairs))
+
+	results, err := QueryBatch(context.Background(), addr.IP.String(), pairs,
+		WithPort(uint16(addr.Port)), WithReadTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("QueryBatch: %v", err)
+	}
+	if len(results) != len(pairs) {
+		t.Fatalf("got %d results, want %d", len(results), len(pairs))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("pair %+v: %v", r.PortPair, r.Err)
+		}
+		want := fmt.Sprintf("user%d", r.PortOnClient)
+		if r.Response.Identifier != want {
+			t.Fatalf("pair %+v: got identifier %q, want %q", r.PortPair, r.Response.Identifier, want)
+		}
+	}
+}
+
+func TestQueryWithDialerUsesSuppliedConnection(t *testing.T) {
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+		line, err := bufio.NewReader(server).ReadString('\n')
+		if err != nil {
+			return
+		}
+		req, ok := parseRequestLine(line)
+		if !ok {
+			return
+		}
+		fmt.Fprintf(server, "%d, %d : USERID : UNIX : piped\r\n", req.ClientPort, req.ServerPort)
+	}()
+
+	dialed := false
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return client, nil
+	}
+
+	resp, err := QueryWithOptions("this-is-never-dialed", 80, 12345, WithDialer(dialer))
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if !dialed {
+		t.Fatal("WithDialer's dialer was never called")
+	}
+	if resp.Identifier != "piped" {
+		t.Fatalf("got %+v", resp)
+	}
+}
+
+func TestQueryContextCancellation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Read the request but never answer it, forcing the client to
+		// wait on cancellation rather than a response.
+		io := make([]byte, 64)
+		conn.Read(io)
+		time.Sleep(5 * time.Second)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = QueryWithOptions(addr.IP.String(), 80, 12345,
+		WithPort(uint16(addr.Port)), WithContext(ctx), WithReadTimeout(5*time.Second))
+	if err == nil {
+		t.Fatal("expected an error from the cancelled context")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("query took %v, want cancellation to cut it well short of the 5s read timeout", elapsed)
+	}
+}
@@ -0,0 +1,101 @@
+package ident
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// Dialer dials an ident connection, matching the signature of
+// (*net.Dialer).DialContext so callers can route lookups through a
+// specific interface, a SOCKS proxy, or an in-memory net.Conn for tests.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// queryOptions holds the resolved configuration for a single Query,
+// QueryContext, QueryWithOptions or QueryBatch call.
+type queryOptions struct {
+	ctx            context.Context
+	dialer         Dialer
+	localAddr      net.Addr
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	port           uint16
+	logger         *log.Logger
+	decodeCharset  bool
+}
+
+func defaultQueryOptions() queryOptions {
+	return queryOptions{
+		port:          defaultPort,
+		decodeCharset: true,
+	}
+}
+
+// QueryOption configures a Query, QueryWithOptions or QueryBatch call.
+type QueryOption func(*queryOptions)
+
+// WithContext makes the lookup cancellable via ctx, in addition to (or
+// instead of) WithConnectTimeout/WithReadTimeout.
+func WithContext(ctx context.Context) QueryOption {
+	return func(o *queryOptions) {
+		o.ctx = ctx
+	}
+}
+
+// WithDialer overrides how the underlying TCP connection is made. This is
+// the hook for routing lookups through a specific interface, a SOCKS proxy,
+// or a fake in-memory net.Conn in tests.
+func WithDialer(d Dialer) QueryOption {
+	return func(o *queryOptions) {
+		o.dialer = d
+	}
+}
+
+// WithLocalAddr sets the local address to dial from. It's ignored if
+// WithDialer is also given, since the custom dialer is responsible for that.
+func WithLocalAddr(addr net.Addr) QueryOption {
+	return func(o *queryOptions) {
+		o.localAddr = addr
+	}
+}
+
+// WithConnectTimeout bounds how long dialing the identd server may take.
+func WithConnectTimeout(d time.Duration) QueryOption {
+	return func(o *queryOptions) {
+		o.connectTimeout = d
+	}
+}
+
+// WithReadTimeout bounds how long we'll wait for the identd server's
+// response line once connected.
+func WithReadTimeout(d time.Duration) QueryOption {
+	return func(o *queryOptions) {
+		o.readTimeout = d
+	}
+}
+
+// WithPort targets a non-standard port, e.g. when talking to a test server.
+func WithPort(port uint16) QueryOption {
+	return func(o *queryOptions) {
+		o.port = port
+	}
+}
+
+// WithLogger lets callers observe non-fatal conditions, such as a
+// QueryBatch connection being closed early by a non-pipelining server.
+func WithLogger(l *log.Logger) QueryOption {
+	return func(o *queryOptions) {
+		o.logger = l
+	}
+}
+
+// WithCharsetDecoding controls whether Response.Identifier is normalized to
+// valid UTF-8, transcoding it when the charset the server announced is one
+// we recognize. It defaults to on; Response.RawIdentifier always carries
+// the untouched bytes regardless of this setting.
+func WithCharsetDecoding(enabled bool) QueryOption {
+	return func(o *queryOptions) {
+		o.decodeCharset = enabled
+	}
+}
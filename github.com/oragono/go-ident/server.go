@@ -0,0 +1,241 @@
+package ident
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Well-known RFC 1413 error types, for use in Handler.Lookup and by the
+// client's ResponseError.
+var (
+	ErrNoUser      = ResponseError{Type: "NO-USER"}
+	ErrInvalidPort = ResponseError{Type: "INVALID-PORT"}
+	ErrHiddenUser  = ResponseError{Type: "HIDDEN-USER"}
+)
+
+const (
+	defaultServerReadTimeout  = 60 * time.Second
+	defaultServerWriteTimeout = 60 * time.Second
+)
+
+// Request is one ident lookup request received by a Server, identifying the
+// TCP connection the peer wants the owning identity of.
+type Request struct {
+	// ClientPort is the port-on-client value from the request line: the
+	// port, on the peer asking us, that originated the connection being
+	// looked up.
+	ClientPort int
+	// ServerPort is the port-on-server value from the request line: our
+	// own port that the connection being looked up was made to.
+	ServerPort int
+	// ClientAddr is the address of the connection being looked up, on
+	// the peer's end. It's derived from the ident connection itself, not
+	// from the request line.
+	ClientAddr net.IP
+	// ServerAddr is our own address that the connection being looked up
+	// was made to.
+	ServerAddr net.IP
+}
+
+// Handler maps a Request to the identity of the user behind it.
+//
+// Lookup should return a Response with at least Identifier set. To report a
+// specific RFC 1413 failure, return ErrNoUser, ErrInvalidPort or
+// ErrHiddenUser (or any other ResponseError); any other non-nil error is
+// reported to the peer as UNKNOWN-ERROR.
+type Handler interface {
+	Lookup(req Request) (Response, error)
+}
+
+// Server answers RFC 1413 ident queries about TCP connections accepted by
+// this process, using a Handler to map the queried ports back to a user.
+// This lets an operator run an in-process identd, e.g. behind NAT or in a
+// container, that answers queries about its own connected clients.
+type Server struct {
+	// Handler resolves incoming Requests. It must be set before Listen
+	// or Serve is called.
+	Handler Handler
+
+	// ReadTimeout bounds how long the server waits for a complete
+	// request line before closing the connection. Defaults to 60s, per
+	// RFC 1413's recommended server-side timeout, if zero.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds how long writing the response may take.
+	// Defaults to 60s if zero.
+	WriteTimeout time.Duration
+	// Logger, if set, receives diagnostics about malformed requests and
+	// connection errors.
+	Logger *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   chan struct{}
+}
+
+// Listen opens a TCP listener on addr (the standard ":113" if addr is
+// empty) and begins serving on it. It returns once the listener is
+// established; connections are accepted in a background goroutine.
+func (s *Server) Listen(addr string) error {
+	if addr == "" {
+		addr = ":113"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts and handles connections from ln in a background goroutine
+// and returns immediately. Accepting stops when Shutdown is called or when
+// Accept fails with a non-temporary error. Each connection is handled in its
+// own goroutine.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.listener = ln
+	s.closed = make(chan struct{})
+	s.mu.Unlock()
+
+	go func() {
+		var retryDelay time.Duration
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-s.closed:
+					return
+				default:
+				}
+
+				// Back off and keep accepting through transient
+				// errors (e.g. EMFILE) rather than tearing down
+				// the listener for good, mirroring the classic
+				// net/http accept-loop pattern.
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					if retryDelay == 0 {
+						retryDelay = 5 * time.Millisecond
+					} else {
+						retryDelay *= 2
+					}
+					if retryDelay > time.Second {
+						retryDelay = time.Second
+					}
+					if s.Logger != nil {
+						s.Logger.Printf("ident: accept error: %v; retrying in %v", err, retryDelay)
+					}
+					time.Sleep(retryDelay)
+					continue
+				}
+
+				if s.Logger != nil {
+					s.Logger.Printf("ident: accept error: %v", err)
+				}
+				return
+			}
+			retryDelay = 0
+			go s.handleConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops accepting new connections and closes the listener.
+// Connections already being handled are left to finish on their own.
+// It's safe to call more than once; calls after the first are no-ops.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	ln := s.listener
+	s.listener = nil
+	close(s.closed)
+	return ln.Close()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	readTimeout := s.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = defaultServerReadTimeout
+	}
+	writeTimeout := s.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = defaultServerWriteTimeout
+	}
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	line, err := readLine(conn)
+	if err != nil {
+		if s.Logger != nil {
+			s.Logger.Printf("ident: read error from %s: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	req, ok := parseRequestLine(line)
+	if !ok {
+		fmt.Fprintf(conn, "%s : ERROR : INVALID-PORT\r\n", strings.TrimSpace(line))
+		return
+	}
+	req.ClientAddr, req.ServerAddr = connAddrs(conn)
+
+	resp, err := s.Handler.Lookup(req)
+	if err != nil {
+		respErr, ok := err.(ResponseError)
+		if !ok {
+			respErr = ResponseError{Type: "UNKNOWN-ERROR"}
+		}
+		fmt.Fprintf(conn, "%d , %d : ERROR : %s\r\n", req.ClientPort, req.ServerPort, respErr.Type)
+		return
+	}
+
+	os := resp.OS
+	if os == "" {
+		os = "UNIX"
+	}
+	fmt.Fprintf(conn, "%d , %d : USERID : %s : %s\r\n", req.ClientPort, req.ServerPort, os, resp.Identifier)
+}
+
+// parseRequestLine parses the standard "client-port , server-port" request
+// line.
+func parseRequestLine(line string) (Request, bool) {
+	parts := strings.SplitN(strings.TrimSpace(line), ",", 2)
+	if len(parts) != 2 {
+		return Request{}, false
+	}
+
+	clientPort, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || clientPort < 1 || clientPort > 65535 {
+		return Request{}, false
+	}
+	serverPort, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || serverPort < 1 || serverPort > 65535 {
+		return Request{}, false
+	}
+
+	return Request{ClientPort: clientPort, ServerPort: serverPort}, true
+}
+
+// connAddrs splits the peer and local addresses off of an accepted
+// connection, for populating Request.ClientAddr and Request.ServerAddr.
+func connAddrs(conn net.Conn) (clientAddr, serverAddr net.IP) {
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		clientAddr = net.ParseIP(host)
+	}
+	if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		serverAddr = net.ParseIP(host)
+	}
+	return clientAddr, serverAddr
+}